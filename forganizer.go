@@ -11,52 +11,130 @@ leaving let's say 30 last days of photos on your phone.
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/barasher/go-exiftool"
 	"github.com/codingsince1985/checksum"
+	"github.com/rwcarlsen/goexif/exif"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type options struct {
-	exif       bool
-	recursive  bool
-	dry_run    bool
-	days_older int
+	time_source      string
+	extractors       []TimeExtractor
+	recursive        bool
+	dry_run          bool
+	days_older       int
+	out              string
+	cas              bool
+	workers          int
+	versions         bool
+	versions_max_age time.Duration
+	manifest         *os.File
 }
 
+// defaultTimeSource preserves the original behavior of falling back to the
+// filesystem mtime when nothing more specific is requested.
+const defaultTimeSource = "mtime"
+
+// contentShardCount is the number of top-level shard directories (one per
+// two-hex-digit prefix) pre-created under DST/content when -cas is on.
+const contentShardCount = 256
+
+// defaultOutTemplate reproduces the original hard-coded %Y/%m layout.
+const defaultOutTemplate = "%Y/%m"
+
 func main() {
 	var opts options
-	flag.BoolVar(&opts.exif, "exif", false, "read date from EXIF data if possible")
+	flag.StringVar(&opts.time_source, "time-source", defaultTimeSource, "comma-separated date extractor chain, tried in order: native,video,xmp,exiftool,mtime")
 	flag.BoolVar(&opts.recursive, "r", false, "recursive into directories")
 	flag.BoolVar(&opts.dry_run, "dry", false, "dry run, do not modify files or directories, only print results")
 	flag.IntVar(&opts.days_older, "d", 0, "only process files older than this number of days")
+	flag.StringVar(&opts.out, "out", defaultOutTemplate, "destination layout template, strftime-style tokens (%Y %y %m %d %H %M %S) plus %f (name) and %e (extension)")
+	flag.BoolVar(&opts.cas, "cas", false, "store files in a content-addressed store under DST/content, symlinked from DST/date")
+	flag.IntVar(&opts.workers, "j", 4, "number of parser/hasher workers reading EXIF data and checksums concurrently")
+	flag.BoolVar(&opts.versions, "versions", false, "archive superseded files into DST/.versions instead of adding _N suffixes, with staggered retention")
+	flag.DurationVar(&opts.versions_max_age, "versions-max-age", 365*24*time.Hour, "maximum age to keep archived versions (only with -versions)")
+	manifestPath := flag.String("manifest", "", "append a JSONL action log to FILE")
+	undoPath := flag.String("undo", "", "reverse the actions recorded in a prior -manifest FILE")
 	flag.Parse()
+
+	if *undoPath != "" {
+		if err := runUndo(*undoPath, opts.dry_run); err != nil {
+			fmt.Printf("Error undoing %v: %v\n", *undoPath, err)
+		}
+		return
+	}
+
 	src, dst := flag.Arg(0), flag.Arg(1)
 	if src == "" || dst == "" {
 		fmt.Println("Error: SRC or DST directories not set")
 		printUsage()
 		return
 	}
+	opts.extractors = buildTimeExtractors(opts.time_source)
+	if *manifestPath != "" {
+		f, err := os.OpenFile(*manifestPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Printf("Error opening manifest %v: %v\n", *manifestPath, err)
+			return
+		}
+		defer f.Close()
+		opts.manifest = f
+	}
+	if opts.cas && !opts.dry_run {
+		if err := createContentShards(dst); err != nil {
+			fmt.Printf("Error creating content store: %v\n", err)
+			return
+		}
+	}
 	processDir(src, dst, opts)
+	if opts.versions {
+		if err := cleanVersions(dst, opts.versions_max_age, opts.dry_run); err != nil {
+			fmt.Printf("Error cleaning up DST/.versions: %v\n", err)
+		}
+	}
 }
 
 var et *exiftool.Exiftool
 
+// fileJob is a source file handed from the walker to a parser/hasher worker.
+type fileJob struct {
+	src_dir string
+	info    os.FileInfo
+}
+
+// moveJob is a file with its date and (for -cas) checksum already resolved,
+// handed from a parser/hasher worker to the single mover goroutine.
+type moveJob struct {
+	src_dir  string
+	info     os.FileInfo
+	mod_time time.Time
+	sum      string
+	sum_err  error
+}
+
+// processDir walks src and moves/links its files into dst, fanning the
+// per-file EXIF/checksum work out across opts.workers goroutines while a
+// single mover goroutine serializes the actual mkdir/rename/symlink calls.
 func processDir(src string, dst string, opts options) {
 	fmt.Printf("Processing directory: %v\n", src)
-	dir, err := os.Open(src)
-	if err != nil {
-		fmt.Printf("Error accessing directory: %v\n", err)
-		return
-	}
-	if opts.exif {
+	if usesExiftool(opts.extractors) {
+		var err error
 		et, err = exiftool.NewExiftool()
 		if err != nil {
 			fmt.Printf("Error when intializing EXIF: %v\n", err)
@@ -64,72 +142,177 @@ func processDir(src string, dst string, opts options) {
 		}
 		defer et.Close()
 	}
-	for {
-		files, err := dir.Readdir(100)
-		if err == io.EOF {
-			return
-		}
+	keep_after := time.Now().AddDate(0, 0, -1*opts.days_older)
+
+	paths := make(chan fileJob, 100)
+	results := make(chan moveJob, 100)
+
+	workers := opts.workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			hashWorker(paths, results, opts)
+		}()
+	}
+
+	moverDone := make(chan struct{})
+	go func() {
+		defer close(moverDone)
+		moveWorker(results, dst, opts)
+	}()
+
+	go func() {
+		walkDir(src, opts, keep_after, paths)
+		close(paths)
+	}()
+
+	wg.Wait()
+	close(results)
+	<-moverDone
+}
+
+// walkDir makes a single filepath.WalkDir pass over src, feeding every file
+// older than keep_after into paths. Subdirectories are skipped entirely
+// (fs.SkipDir) unless opts.recursive is set, and exiftool/keep_after are
+// resolved once by the caller rather than per directory.
+func walkDir(src string, opts options, keep_after time.Time, paths chan<- fileJob) {
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
-			fmt.Printf("Error listing directory %v: %v\n", src, err)
-			return
+			fmt.Printf("Error accessing %v: %v\n", p, err)
+			return nil
 		}
-		keep_after := time.Now().AddDate(0, 0, -1*opts.days_older)
-		for i := 0; i < len(files); i++ {
-			if files[i].IsDir() {
-				if opts.recursive {
-					defer processDir(path.Join(src, files[i].Name()), dst, opts)
-				}
-				continue
+		if d.IsDir() {
+			if p != src && !opts.recursive {
+				return fs.SkipDir
 			}
-			mod_time := files[i].ModTime()
-			if mod_time.After(keep_after) {
-				fmt.Println("  Skipping file ", files[i].Name(), ": is too new ", files[i].ModTime())
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			fmt.Printf("Error reading info for %v: %v\n", p, err)
+			return nil
+		}
+		if info.ModTime().After(keep_after) {
+			fmt.Println("  Skipping file ", info.Name(), ": is too new ", info.ModTime())
+			return nil
+		}
+		paths <- fileJob{filepath.Dir(p), info}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error walking directory %v: %v\n", src, err)
+	}
+}
+
+// hashWorker resolves each incoming file's date (EXIF or mtime) and, for
+// -cas, its sha256 checksum, then hands the result to the mover.
+func hashWorker(paths <-chan fileJob, results chan<- moveJob, opts options) {
+	for job := range paths {
+		source_path := path.Join(job.src_dir, job.info.Name())
+		mv := moveJob{src_dir: job.src_dir, info: job.info, mod_time: resolveModTime(source_path, job.info, opts)}
+		if opts.cas {
+			mv.sum, mv.sum_err = checksum.SHA256sum(source_path)
+		}
+		results <- mv
+	}
+}
+
+// moveWorker applies every resolved moveJob in order, the single point
+// where directories get created and files get renamed/symlinked/removed.
+func moveWorker(results <-chan moveJob, dst string, opts options) {
+	for mv := range results {
+		fmt.Printf("  Processing file: %v\n", mv.info.Name())
+		if opts.cas {
+			if mv.sum_err != nil {
+				fmt.Println("    sha256 error:", mv.sum_err)
 				continue
 			}
-			fmt.Printf("  Processing file: %v\n", files[i].Name())
-			processFile(src, files[i], dst, opts)
+			source_path := path.Join(mv.src_dir, mv.info.Name())
+			processFileCAS(source_path, mv.info, mv.info.Name(), mv.mod_time, dst, opts, mv.sum)
+			continue
+		}
+		processFile(mv.src_dir, mv.info, dst, opts, mv.mod_time)
+	}
+}
+
+// resolveModTime tries each configured TimeExtractor in order, falling back
+// to the filesystem mtime if none of them resolve a date.
+func resolveModTime(source_path string, info os.FileInfo, opts options) time.Time {
+	for _, extractor := range opts.extractors {
+		t, err := extractor.ExtractTime(source_path)
+		if err == nil {
+			return t
 		}
+		fmt.Printf("    %s error: %v\n", extractor.Name(), err)
 	}
+	return info.ModTime()
 }
 
-func processFile(src_dir string, source os.FileInfo, dst_dir string, opts options) {
-	var mod_time time.Time
-	var err error
+func processFile(src_dir string, source os.FileInfo, dst_dir string, opts options, mod_time time.Time) {
 	name := source.Name()
 	source_path := path.Join(src_dir, name)
-	if opts.exif {
-		mod_time, err = getExifTime(source_path)
-		if err != nil {
-			fmt.Println("    Exif error:", err)
-			mod_time = source.ModTime()
-		}
-	} else {
-		mod_time = source.ModTime()
+	target_dir, target_path := resolveTargetPath(dst_dir, opts.out, mod_time, name)
+
+	var sum string
+	if opts.manifest != nil {
+		sum, _ = checksum.SHA256sum(source_path)
+	}
+	mtime_str := source.ModTime().Format(time.RFC3339)
+	var exif_time_str string
+	if len(opts.extractors) > 0 {
+		exif_time_str = mod_time.Format(time.RFC3339)
 	}
-	target_dir := path.Join(
-		dst_dir,
-		fmt.Sprintf("%d/%02d", mod_time.Year(), mod_time.Month()))
-	target_path := path.Join(target_dir, name)
+
 	fmt.Print("    -> ", target_path, ": ")
 	if is_exists, target := isExists(target_path); is_exists {
 		if os.SameFile(source, target) {
 			fmt.Println("same file, skipping")
+			writeManifestEntry(opts, ManifestEntry{Src: source_path, Dst: target_path, Action: "skip", SHA256: sum, MTime: mtime_str, ExifTime: exif_time_str})
 			return
 		}
 		if haveSameContents(source_path, target_path) {
 			fmt.Print("same contents, ")
+			trash_path := ""
 			if !opts.dry_run {
+				if opts.manifest != nil {
+					if p, err := backupToTrash(dst_dir, source_path, sum); err != nil {
+						fmt.Println("error backing up to trash: ", err)
+						return
+					} else {
+						trash_path = p
+					}
+				}
 				err := os.Remove(source_path)
 				if err != nil {
 					fmt.Println("error removing: ", err)
 					return
 				}
+			} else if opts.manifest != nil {
+				trash_path = path.Join(dst_dir, ".trash", sum)
 			}
 			fmt.Println("source removed")
+			writeManifestEntry(opts, ManifestEntry{Src: source_path, Dst: trash_path, Action: "dedup-remove", SHA256: sum, MTime: mtime_str, ExifTime: exif_time_str})
 			return
 		}
-		target_path = genUniqueName(target_dir, name)
-		fmt.Print("different file exists, moving to -> ", target_path, ": ")
+		if opts.versions {
+			if !opts.dry_run {
+				archived_path, err := archiveVersion(dst_dir, target_dir, target_path, name)
+				if err != nil {
+					fmt.Println("error archiving previous version: ", err)
+					return
+				}
+				writeManifestEntry(opts, ManifestEntry{Src: target_path, Dst: archived_path, Action: "version-archive"})
+			}
+			fmt.Print("different file exists, archived previous version, moving to -> ", target_path, ": ")
+		} else {
+			target_path = genUniqueName(target_dir, name)
+			fmt.Print("different file exists, moving to -> ", target_path, ": ")
+		}
 	}
 	if !opts.dry_run {
 		if exists, _ := isExists(target_dir); !exists {
@@ -147,6 +330,144 @@ func processFile(src_dir string, source os.FileInfo, dst_dir string, opts option
 		}
 	}
 	fmt.Println("moved")
+	writeManifestEntry(opts, ManifestEntry{Src: source_path, Dst: target_path, Action: "move", SHA256: sum, MTime: mtime_str, ExifTime: exif_time_str})
+}
+
+// ManifestEntry is one JSONL record written to -manifest for every action
+// taken, and read back by -undo to reverse it.
+type ManifestEntry struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst,omitempty"`
+	Action   string `json:"action"`
+	SHA256   string `json:"sha256,omitempty"`
+	MTime    string `json:"mtime,omitempty"`
+	ExifTime string `json:"exif_time,omitempty"`
+	Dry      bool   `json:"dry"`
+}
+
+// writeManifestEntry appends entry as a JSON line to opts.manifest, if set.
+func writeManifestEntry(opts options, entry ManifestEntry) {
+	if opts.manifest == nil {
+		return
+	}
+	entry.Dry = opts.dry_run
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Println("Error encoding manifest entry: ", err)
+		return
+	}
+	data = append(data, '\n')
+	if _, err := opts.manifest.Write(data); err != nil {
+		fmt.Println("Error writing manifest entry: ", err)
+	}
+}
+
+// copyFile copies src to dst, used to keep a restorable .trash copy of a
+// dedup-removed file and, on undo, to restore it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// backupToTrash keeps a copy of source_path under dst_dir/.trash/<sum>
+// before it gets removed as a duplicate, so -undo can restore it later.
+func backupToTrash(dst_dir, source_path, sum string) (string, error) {
+	if sum == "" {
+		return "", errors.New("no checksum available for trash backup")
+	}
+	trash_dir := path.Join(dst_dir, ".trash")
+	if exists, _ := isExists(trash_dir); !exists {
+		if err := os.MkdirAll(trash_dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	trash_path := path.Join(trash_dir, sum)
+	return trash_path, copyFile(source_path, trash_path)
+}
+
+// runUndo replays a -manifest file in reverse, moving files back to src
+// and restoring dedup-removed files from their .trash copy where available.
+func runUndo(manifestPath string, dry_run bool) error {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i] == "" {
+			continue
+		}
+		var entry ManifestEntry
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			fmt.Println("Error parsing manifest line: ", err)
+			continue
+		}
+		undoEntry(entry, dry_run)
+	}
+	return nil
+}
+
+func undoEntry(entry ManifestEntry, dry_run bool) {
+	switch entry.Action {
+	case "skip":
+		return
+	case "move", "version-archive":
+		if exists, _ := isExists(entry.Src); exists {
+			fmt.Println("  Skipping undo, source already exists: ", entry.Src)
+			return
+		}
+		if exists, _ := isExists(entry.Dst); !exists {
+			fmt.Println("  Skipping undo, moved file missing: ", entry.Dst)
+			return
+		}
+		fmt.Println("  Undo move: ", entry.Dst, " -> ", entry.Src)
+		if dry_run {
+			return
+		}
+		if err := os.Rename(entry.Dst, entry.Src); err != nil {
+			fmt.Println("    error: ", err)
+		}
+	case "dedup-remove", "dedup-remove-cas":
+		if entry.SHA256 == "" || entry.Dst == "" {
+			fmt.Println("  Cannot undo dedup-remove without a stored checksum and backup copy: ", entry.Src)
+			return
+		}
+		if exists, _ := isExists(entry.Src); exists {
+			fmt.Println("  Skipping undo, source already exists: ", entry.Src)
+			return
+		}
+		if exists, _ := isExists(entry.Dst); !exists {
+			fmt.Println("  Skipping undo, backup copy missing: ", entry.Dst)
+			return
+		}
+		fmt.Println("  Undo dedup-remove: ", entry.Dst, " -> ", entry.Src)
+		if dry_run {
+			return
+		}
+		if err := copyFile(entry.Dst, entry.Src); err != nil {
+			fmt.Println("    error restoring: ", err)
+			return
+		}
+		if entry.Action == "dedup-remove" {
+			// entry.Dst is a .trash-only copy; for dedup-remove-cas it's the
+			// shared content-store file, which other symlinks still need.
+			if err := os.Remove(entry.Dst); err != nil {
+				fmt.Println("    error removing .trash copy: ", err)
+			}
+		}
+	default:
+		fmt.Println("  Unknown action, skipping: ", entry.Action)
+	}
 }
 
 func isExists(filename string) (bool, os.FileInfo) {
@@ -157,18 +478,354 @@ func isExists(filename string) (bool, os.FileInfo) {
 	return true, fileinfo
 }
 
-func genUniqueName(dir, filename string) string {
+// splitNameExt splits a filename into its base name and extension (without the dot).
+func splitNameExt(filename string) (name, ext string) {
 	split := strings.Split(filename, ".")
-	var name, ext string
 	switch len(split) {
 	case 1:
-		name, ext = split[0], ""
+		return split[0], ""
 	case 2:
-		name, ext = split[0], split[1]
+		return split[0], split[1]
 	default:
-		name = strings.Join(split[0:len(split)-1], ".")
-		ext = split[len(split)-1]
+		return strings.Join(split[0:len(split)-1], "."), split[len(split)-1]
+	}
+}
+
+// strftimeToGo maps the subset of strftime tokens this tool understands to
+// Go's reference-time layout, applied in longest-match order.
+var strftimeToGo = []struct{ token, layout string }{
+	{"%Y", "2006"},
+	{"%y", "06"},
+	{"%m", "01"},
+	{"%d", "02"},
+	{"%H", "15"},
+	{"%M", "04"},
+	{"%S", "05"},
+}
+
+// fNamePlaceholder and fExtPlaceholder stand in for %f and %e while the rest
+// of the template is run through time.Format, since those two tokens depend
+// on the filename rather than the resolved date.
+const (
+	fNamePlaceholder = "\x00forganizer-name\x00"
+	fExtPlaceholder  = "\x00forganizer-ext\x00"
+)
+
+// expandOutTemplate expands a -out template against the resolved date and
+// the original filename, translating strftime-style tokens to Go's
+// time.Format layout along the way.
+func expandOutTemplate(tmpl string, t time.Time, filename string) string {
+	layout := strings.ReplaceAll(tmpl, "%f", fNamePlaceholder)
+	layout = strings.ReplaceAll(layout, "%e", fExtPlaceholder)
+	for _, tok := range strftimeToGo {
+		layout = strings.ReplaceAll(layout, tok.token, tok.layout)
+	}
+	name, ext := splitNameExt(filename)
+	expanded := t.Format(layout)
+	expanded = strings.ReplaceAll(expanded, fNamePlaceholder, name)
+	expanded = strings.ReplaceAll(expanded, fExtPlaceholder, ext)
+	return expanded
+}
+
+// resolveTargetPath expands tmpl under root for the given date and filename,
+// returning both the target directory and the full target path. If tmpl
+// contains %f the expansion already names the file; otherwise the original
+// filename is appended to the expanded directory.
+func resolveTargetPath(root string, tmpl string, t time.Time, name string) (dir, full string) {
+	rel := expandOutTemplate(tmpl, t, name)
+	if strings.Contains(tmpl, "%f") {
+		full = path.Join(root, rel)
+		dir = path.Dir(full)
+		return
+	}
+	dir = path.Join(root, rel)
+	full = path.Join(dir, name)
+	return
+}
+
+// createContentShards pre-creates the 256 two-hex-digit shard directories
+// under DST/content so individual file moves never need to check for them.
+func createContentShards(dst_dir string) error {
+	for i := 0; i < contentShardCount; i++ {
+		shard := fmt.Sprintf("%02x", i)
+		if err := os.MkdirAll(path.Join(dst_dir, "content", shard), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentFilename builds the content-store filename for a given sha256 sum,
+// keeping the original extension so the store stays browsable.
+func contentFilename(sum, ext string) string {
+	if ext == "" {
+		return sum
+	}
+	return sum + "." + ext
+}
+
+// processFileCAS arranges source_path into DST's content-addressed store,
+// deduplicating by the caller-supplied SHA-256 sum, and symlinks it in from
+// DST/date using the same -out template as the plain date-bucket mode.
+func processFileCAS(source_path string, source os.FileInfo, name string, mod_time time.Time, dst_dir string, opts options, sum string) {
+	mtime_str := source.ModTime().Format(time.RFC3339)
+	var exif_time_str string
+	if len(opts.extractors) > 0 {
+		exif_time_str = mod_time.Format(time.RFC3339)
+	}
+	_, ext := splitNameExt(name)
+	content_dir := path.Join(dst_dir, "content", sum[:2])
+	content_path := path.Join(content_dir, contentFilename(sum, ext))
+	fmt.Print("    -> ", content_path, ": ")
+	if exists, _ := isExists(content_path); exists {
+		identical, err := haveIdenticalBytes(source_path, content_path)
+		if err != nil {
+			fmt.Println("error comparing with existing content entry: ", err)
+			return
+		}
+		if !identical {
+			// sha256 collision between genuinely different contents: extremely
+			// unlikely, but don't silently merge them.
+			content_path = genUniqueName(content_dir, contentFilename(sum, ext))
+			fmt.Print("sha256 collision with different contents, storing as -> ", content_path, ": ")
+		} else {
+			if !opts.dry_run {
+				if err := os.Remove(source_path); err != nil {
+					fmt.Println("error removing: ", err)
+					return
+				}
+			}
+			fmt.Print("already in content store, source removed; ")
+			// the file's bytes still live on in the content store, so there's
+			// no need for a separate .trash copy the way the plain dedup path
+			// needs one; -undo just re-copies from content_path.
+			writeManifestEntry(opts, ManifestEntry{Src: source_path, Dst: content_path, Action: "dedup-remove-cas", SHA256: sum, MTime: mtime_str, ExifTime: exif_time_str})
+		}
+	}
+	if exists, _ := isExists(content_path); !exists {
+		if !opts.dry_run {
+			err := os.Rename(source_path, content_path)
+			if err != nil {
+				fmt.Println("error moving into content store: ", err)
+				return
+			}
+		}
+		fmt.Print("stored; ")
+	}
+	// symlinks resolve relative to their own directory, not cwd, so a
+	// relative content_path (the common case when dst is given as a
+	// relative path) must be re-anchored to an absolute path before linking,
+	// and compared against as such when checking for an existing link.
+	link_target, err := filepath.Abs(content_path)
+	if err != nil {
+		fmt.Println("error resolving content path: ", err)
+		return
+	}
+	date_dir, link_path := resolveTargetPath(path.Join(dst_dir, "date"), opts.out, mod_time, name)
+	// isExists follows symlinks (os.Stat), so it can't tell us link_path is a
+	// symlink at all; Lstat the entry itself to check.
+	if existing, err := os.Lstat(link_path); err == nil {
+		if existing.Mode()&os.ModeSymlink != 0 {
+			if dest, err := os.Readlink(link_path); err == nil && dest == link_target {
+				fmt.Println("date link already present")
+				writeManifestEntry(opts, ManifestEntry{Src: source_path, Dst: link_path, Action: "skip", SHA256: sum, MTime: mtime_str, ExifTime: exif_time_str})
+				return
+			}
+		}
+		link_path = genUniqueName(date_dir, name)
 	}
+	if !opts.dry_run {
+		if exists, _ := isExists(date_dir); !exists {
+			_, src_dir_info := isExists(path.Dir(source_path))
+			if err := os.MkdirAll(date_dir, src_dir_info.Mode()); err != nil {
+				fmt.Println("error creating date directory: ", err)
+				return
+			}
+		}
+		if err := os.Symlink(link_target, link_path); err != nil {
+			fmt.Println("error symlinking: ", err)
+			return
+		}
+	}
+	fmt.Println("linked -> ", link_path)
+	writeManifestEntry(opts, ManifestEntry{Src: source_path, Dst: link_path, Action: "move", SHA256: sum, MTime: mtime_str, ExifTime: exif_time_str})
+}
+
+// haveIdenticalBytes compares two files byte-by-byte, used to verify a
+// sha256 match in the content store isn't a hash collision.
+func haveIdenticalBytes(file1, file2 string) (bool, error) {
+	info1, err := os.Stat(file1)
+	if err != nil {
+		return false, err
+	}
+	info2, err := os.Stat(file2)
+	if err != nil {
+		return false, err
+	}
+	if info1.Size() != info2.Size() {
+		return false, nil
+	}
+	f1, err := os.Open(file1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(file2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+	buf1 := make([]byte, 64*1024)
+	buf2 := make([]byte, 64*1024)
+	for {
+		n1, err1 := f1.Read(buf1)
+		n2, err2 := f2.Read(buf2)
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		if err1 == io.EOF && err2 == io.EOF {
+			return true, nil
+		}
+		if err1 != nil && err1 != io.EOF {
+			return false, err1
+		}
+		if err2 != nil && err2 != io.EOF {
+			return false, err2
+		}
+	}
+}
+
+// archiveVersion moves the existing file at target_path into a parallel
+// DST/.versions tree (mirroring target_dir's position under dst_dir),
+// suffixed with the archival unix timestamp, freeing target_path for the
+// incoming file. It returns the path the file was archived to, so the
+// caller can record the move in the manifest.
+func archiveVersion(dst_dir, target_dir, target_path, name string) (string, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(target_dir, dst_dir), "/")
+	versions_dir := path.Join(dst_dir, ".versions", rel)
+	if exists, _ := isExists(versions_dir); !exists {
+		_, target_dir_info := isExists(target_dir)
+		if err := os.MkdirAll(versions_dir, target_dir_info.Mode()); err != nil {
+			return "", err
+		}
+	}
+	base, ext := splitNameExt(name)
+	archived_name := fmt.Sprintf("%s~%d", base, time.Now().Unix())
+	if ext != "" {
+		archived_name += "." + ext
+	}
+	archived_path := path.Join(versions_dir, archived_name)
+	if err := os.Rename(target_path, archived_path); err != nil {
+		return "", err
+	}
+	return archived_path, nil
+}
+
+// retentionInterval says that, for versions up to `end` old, only one
+// version per `step`-sized time bucket is kept (step 0 means keep all).
+type retentionInterval struct {
+	end  time.Duration
+	step time.Duration
+}
+
+// versionRetentionSchedule implements "keep every version for 1 hour,
+// hourly for 1 day, daily for 30 days, weekly thereafter up to max_age".
+// Every tier's end is clamped to max_age so a max_age configured below the
+// hardcoded tiers is still honored instead of being overridden by them.
+func versionRetentionSchedule(max_age time.Duration) []retentionInterval {
+	return []retentionInterval{
+		{end: min(time.Hour, max_age), step: 0},
+		{end: min(24*time.Hour, max_age), step: time.Hour},
+		{end: min(30*24*time.Hour, max_age), step: 24 * time.Hour},
+		{end: max_age, step: 7 * 24 * time.Hour},
+	}
+}
+
+// retentionStep returns the bucket size that applies to a version of the
+// given age, or ok=false if the version has aged out of every interval.
+func retentionStep(age time.Duration, schedule []retentionInterval) (step time.Duration, ok bool) {
+	for _, iv := range schedule {
+		if age <= iv.end {
+			return iv.step, true
+		}
+	}
+	return 0, false
+}
+
+// versionFilePattern matches the `<name>~<unixts>[.<ext>]` files archiveVersion writes.
+var versionFilePattern = regexp.MustCompile(`^(.*)~(\d+)(\.[^.]+)?$`)
+
+type versionEntry struct {
+	path string
+	ts   int64
+}
+
+// cleanVersions walks dst_dir/.versions and thins out each group of
+// same-name archived versions according to versionRetentionSchedule,
+// deleting both versions older than max_age and versions whose retention
+// slot is already held by a newer one.
+func cleanVersions(dst_dir string, max_age time.Duration, dry_run bool) error {
+	versions_root := path.Join(dst_dir, ".versions")
+	if exists, _ := isExists(versions_root); !exists {
+		return nil
+	}
+	groups := map[string][]versionEntry{}
+	err := filepath.WalkDir(versions_root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		m := versionFilePattern.FindStringSubmatch(d.Name())
+		if m == nil {
+			return nil
+		}
+		ts, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return nil
+		}
+		key := path.Join(filepath.Dir(p), m[1]+m[3])
+		groups[key] = append(groups[key], versionEntry{path: p, ts: ts})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	schedule := versionRetentionSchedule(max_age)
+	now := time.Now()
+	for _, versions := range groups {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].ts < versions[j].ts })
+		slots := map[int64]string{}
+		for _, v := range versions {
+			age := now.Sub(time.Unix(v.ts, 0))
+			step, ok := retentionStep(age, schedule)
+			if !ok {
+				removeVersion(v.path, dry_run)
+				continue
+			}
+			if step == 0 {
+				continue
+			}
+			bucket := v.ts / int64(step.Seconds())
+			if occupant, found := slots[bucket]; found {
+				removeVersion(occupant, dry_run)
+			}
+			slots[bucket] = v.path
+		}
+	}
+	return nil
+}
+
+func removeVersion(p string, dry_run bool) {
+	fmt.Println("  Pruning version: ", p)
+	if dry_run {
+		return
+	}
+	if err := os.Remove(p); err != nil {
+		fmt.Println("    error removing version: ", err)
+	}
+}
+
+func genUniqueName(dir, filename string) string {
+	name, ext := splitNameExt(filename)
 	for i := 1; i > 0; i++ {
 		newpath := path.Join(dir, fmt.Sprintf("%s_%d.%s", name, i, ext))
 		if is_exists, _ := isExists(newpath); !is_exists {
@@ -197,6 +854,264 @@ func toString(v interface{}) string {
 	}
 }
 
+// TimeExtractor resolves a file's original capture time from somewhere
+// other than its filesystem mtime. Extractors are tried in the order given
+// to -time-source, and resolveModTime falls back to the mtime if all of
+// them return an error.
+type TimeExtractor interface {
+	// Name identifies the extractor in log output.
+	Name() string
+	// ExtractTime returns the resolved time, or an error if this extractor
+	// found nothing usable for path.
+	ExtractTime(path string) (time.Time, error)
+}
+
+// buildTimeExtractors turns a comma-separated -time-source value into the
+// ordered extractor chain resolveModTime will try. Unknown entries are
+// logged and skipped.
+func buildTimeExtractors(time_source string) []TimeExtractor {
+	var extractors []TimeExtractor
+	for _, name := range strings.Split(time_source, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+			continue
+		case "native":
+			extractors = append(extractors, nativeExifExtractor{})
+		case "video":
+			extractors = append(extractors, videoExtractor{})
+		case "xmp":
+			extractors = append(extractors, xmpExtractor{})
+		case "exiftool":
+			extractors = append(extractors, exiftoolExtractor{})
+		case "mtime":
+			extractors = append(extractors, mtimeExtractor{})
+		default:
+			fmt.Printf("Unknown -time-source entry %q, ignoring\n", name)
+		}
+	}
+	return extractors
+}
+
+// usesExiftool reports whether extractors includes exiftoolExtractor, so
+// processDir only pays for starting the exiftool subprocess when needed.
+func usesExiftool(extractors []TimeExtractor) bool {
+	for _, e := range extractors {
+		if _, ok := e.(exiftoolExtractor); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nativeExifExtractor decodes EXIF directly in pure Go, for the common case
+// where shelling out to exiftool isn't available or desired.
+type nativeExifExtractor struct{}
+
+func (nativeExifExtractor) Name() string { return "native EXIF" }
+
+func (nativeExifExtractor) ExtractTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return x.DateTime()
+}
+
+// exiftoolExtractor shells out to exiftool via the package-level et handle;
+// the original and most format-complete extractor.
+type exiftoolExtractor struct{}
+
+func (exiftoolExtractor) Name() string { return "exiftool" }
+
+func (exiftoolExtractor) ExtractTime(path string) (time.Time, error) {
+	return getExifTime(path)
+}
+
+// mtimeExtractor resolves to the filesystem modification time. Listing it
+// explicitly in -time-source lets it be slotted anywhere in the chain,
+// rather than only ever applying as resolveModTime's final fallback.
+type mtimeExtractor struct{}
+
+func (mtimeExtractor) Name() string { return "mtime" }
+
+func (mtimeExtractor) ExtractTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// xmpSidecarPath returns the conventional sidecar path for a media file:
+// the same name with its extension replaced by ".xmp".
+func xmpSidecarPath(p string) string {
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + ".xmp"
+}
+
+// xmpDatePattern pulls a date/time value out of an XMP sidecar's
+// DateTimeOriginal or CreateDate field, whether it's written as element text
+// or as an RDF attribute.
+var xmpDatePattern = regexp.MustCompile(`(?:DateTimeOriginal|CreateDate)[^>"]*?(?:>|=")([0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}:[0-9]{2}:[0-9]{2})`)
+
+// xmpExtractor reads the creation date from a <name>.xmp sidecar file, the
+// format written by tools like Lightroom or darktable next to a raw image.
+type xmpExtractor struct{}
+
+func (xmpExtractor) Name() string { return "XMP sidecar" }
+
+func (xmpExtractor) ExtractTime(path string) (time.Time, error) {
+	data, err := os.ReadFile(xmpSidecarPath(path))
+	if err != nil {
+		return time.Time{}, err
+	}
+	m := xmpDatePattern.FindSubmatch(data)
+	if m == nil {
+		return time.Time{}, errors.New("no date found in XMP sidecar")
+	}
+	return time.Parse("2006-01-02T15:04:05", string(m[1]))
+}
+
+// quicktimeEpoch is the MP4/QuickTime reference date (1904-01-01 UTC); an
+// mvhd box's creation time is seconds since this, not the Unix epoch.
+var quicktimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// videoExtractor reads the creation time out of a QuickTime/MP4 container's
+// moov/mvhd box, for .mov/.mp4/.m4v files exiftool isn't available for.
+type videoExtractor struct{}
+
+func (videoExtractor) Name() string { return "video" }
+
+func (videoExtractor) ExtractTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	return mvhdTime(f)
+}
+
+// readBoxHeader reads one ISO-BMFF box header (32-bit size + fourCC, or the
+// 64-bit extended form when size == 1) and returns its type and payload size.
+// A payload size of -1 means the box extends to the end of the input.
+func readBoxHeader(r io.Reader) (boxType string, payloadSize int64, err error) {
+	var hdr [8]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+	boxType = string(hdr[4:8])
+	headerSize := int64(8)
+	if size == 1 {
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(ext[:]))
+		headerSize = 16
+	}
+	if size == 0 {
+		return boxType, -1, nil
+	}
+	return boxType, size - headerSize, nil
+}
+
+// findTopLevelBox scans r for a top-level box with the given fourCC (e.g.
+// "moov") and returns its payload.
+func findTopLevelBox(r io.ReadSeeker, want string) ([]byte, error) {
+	for {
+		boxType, size, err := readBoxHeader(r)
+		if err == io.EOF {
+			return nil, fmt.Errorf("box %q not found", want)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			cur, err := r.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			end, err := r.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+			size = end - cur
+			if _, err := r.Seek(cur, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		if boxType == want {
+			payload := make([]byte, size)
+			_, err := io.ReadFull(r, payload)
+			return payload, err
+		}
+		if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// findChildBox returns the payload of the first direct child box with the
+// given fourCC inside data (e.g. "mvhd" inside a "moov" payload).
+func findChildBox(data []byte, want string) ([]byte, error) {
+	r := bytes.NewReader(data)
+	for {
+		boxType, size, err := readBoxHeader(r)
+		if err == io.EOF {
+			return nil, fmt.Errorf("box %q not found", want)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			size = int64(r.Len())
+		}
+		if boxType == want {
+			payload := make([]byte, size)
+			_, err := io.ReadFull(r, payload)
+			return payload, err
+		}
+		if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// mvhdTime parses the creation_time field out of the moov/mvhd box of an
+// ISO-BMFF (MP4/QuickTime) file.
+func mvhdTime(r io.ReadSeeker) (time.Time, error) {
+	moov, err := findTopLevelBox(r, "moov")
+	if err != nil {
+		return time.Time{}, err
+	}
+	mvhd, err := findChildBox(moov, "mvhd")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(mvhd) < 1 {
+		return time.Time{}, errors.New("mvhd box too short")
+	}
+	var seconds uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 12 {
+			return time.Time{}, errors.New("mvhd box too short")
+		}
+		seconds = binary.BigEndian.Uint64(mvhd[4:12])
+	} else {
+		if len(mvhd) < 8 {
+			return time.Time{}, errors.New("mvhd box too short")
+		}
+		seconds = uint64(binary.BigEndian.Uint32(mvhd[4:8]))
+	}
+	return quicktimeEpoch.Add(time.Duration(seconds) * time.Second), nil
+}
+
 func getExifTime(path string) (time.Time, error) {
 	var (
 		t time.Time
@@ -226,9 +1141,8 @@ func getExifTime(path string) (time.Time, error) {
 	return t, nil
 }
 
-func printUsage() {
-	fmt.Println(`
-Usage: forganize [-r] [-dry] [-exif] [-d DAYS] SRC DST
+const usageText = `
+Usage: forganize [-r] [-dry] [-time-source LIST] [-d DAYS] [-out TEMPLATE] [-j N] SRC DST
 
 SRC - source directory
 DST - root directory for organized files
@@ -236,7 +1150,25 @@ DST - root directory for organized files
 Options:
     -r - scan files recursively into SRC subdirectories
     -d DAYS - do not process files newer than DAYS days from now
-    -exif - use EXIF date if possible (needs installed exiftool package)
+    -time-source LIST - comma-separated date extractor chain, tried in order
+                    until one succeeds (default "mtime"):
+                    native - decode EXIF directly (no external dependency)
+                    video - read the creation time from a QuickTime/MP4 container
+                    xmp - read a <name>.xmp sidecar file
+                    exiftool - use exiftool (needs installed exiftool package)
+                    mtime - fall back to the filesystem modification time
+    -out TEMPLATE - destination layout template (default "%Y/%m"). Tokens:
+                    %Y %y %m %d %H %M %S - strftime-style date/time fields
+                    %f - original filename, %e - original extension
+    -cas - store files content-addressed under DST/content, symlinked from DST/date
+    -j N - number of concurrent EXIF/checksum workers (default 4)
+    -versions - archive superseded files into DST/.versions instead of _N suffixes
+    -versions-max-age DURATION - retention cutoff for DST/.versions (default 8760h)
+    -manifest FILE - append a JSONL log of every action taken to FILE
+    -undo FILE - reverse the actions recorded in a prior -manifest FILE (no SRC/DST needed)
     -dry - dry run
-`)
+`
+
+func printUsage() {
+	os.Stdout.WriteString(usageText)
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandOutTemplate(t *testing.T) {
+	when := time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+	cases := []struct {
+		tmpl, filename, want string
+	}{
+		{"%Y/%m", "photo1.jpg", "2023/05"},
+		{"%Y/%m/%d-%H%M%S", "photo1.jpg", "2023/05/06-070809"},
+		{"%Y/%f.%e", "photo1.jpg", "2023/photo1.jpg"},
+		{"flat", "photo1.jpg", "flat"},
+	}
+	for _, c := range cases {
+		got := expandOutTemplate(c.tmpl, when, c.filename)
+		if got != c.want {
+			t.Errorf("expandOutTemplate(%q, _, %q) = %q, want %q", c.tmpl, c.filename, got, c.want)
+		}
+	}
+}
+
+// TestProcessFileCASRelativeDst guards against the symlink target being
+// stored relative to cwd (which os.Symlink resolves relative to the
+// symlink's own directory, not cwd) when dst is itself a relative path.
+func TestProcessFileCASRelativeDst(t *testing.T) {
+	tmp := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir("src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("dst", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("src/photo1.jpg", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat("src/photo1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := createContentShards("dst"); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{out: "%Y/%m"}
+	when := time.Date(2023, 5, 6, 0, 0, 0, 0, time.UTC)
+	sum := strings.Repeat("a", 64)
+	processFileCAS("src/photo1.jpg", info, "photo1.jpg", when, "dst", opts, sum)
+
+	linkPath := filepath.Join("dst", "date", "2023", "05", "photo1.jpg")
+	data, err := os.ReadFile(linkPath)
+	if err != nil {
+		t.Fatalf("reading through symlink %s: %v", linkPath, err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("content via symlink = %q, want %q", data, "hello world")
+	}
+}
+
+// TestProcessFileCASRelativeDstSkipsExistingLink guards against the
+// existing-link check comparing os.Readlink's absolute result against a
+// still-relative content_path: with dst relative, that always missed, so
+// processing the same content/name twice (a second run, or two
+// identically-named duplicates found under -r) created photo1_1.jpg instead
+// of recognizing the link already present.
+func TestProcessFileCASRelativeDstSkipsExistingLink(t *testing.T) {
+	tmp := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir("src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("dst", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := createContentShards("dst"); err != nil {
+		t.Fatal(err)
+	}
+	opts := options{out: "%Y/%m"}
+	when := time.Date(2023, 5, 6, 0, 0, 0, 0, time.UTC)
+	sum := strings.Repeat("a", 64)
+
+	for i, src := range []string{"src/photo1.jpg", "src/dup-photo1.jpg"} {
+		if err := os.WriteFile(src, []byte("hello world"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		processFileCAS(src, info, "photo1.jpg", when, "dst", opts, sum)
+		if i == 1 {
+			if _, statErr := os.Stat(src); statErr == nil {
+				t.Error("duplicate source was not removed on second processFileCAS call")
+			}
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join("dst", "date", "2023", "05", "photo1*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("date dir entries = %v, want exactly one link (no _1 suffix)", matches)
+	}
+}
+
+// TestRetentionStepHonorsSmallMaxAge guards against a configured max_age
+// smaller than the hardcoded 24h/30-day tiers being silently overridden by
+// them: a version should age out once it's past max_age, regardless of
+// where max_age falls relative to those tiers.
+func TestRetentionStepHonorsSmallMaxAge(t *testing.T) {
+	schedule := versionRetentionSchedule(2 * time.Hour)
+	cases := []struct {
+		age    time.Duration
+		wantOK bool
+	}{
+		{30 * time.Minute, true},
+		{10 * time.Hour, false},
+		{120 * time.Hour, false},
+	}
+	for _, c := range cases {
+		_, ok := retentionStep(c.age, schedule)
+		if ok != c.wantOK {
+			t.Errorf("retentionStep(%v, schedule(max_age=2h)) ok = %v, want %v", c.age, ok, c.wantOK)
+		}
+	}
+}
+
+func TestRetentionStepDefaultTiers(t *testing.T) {
+	schedule := versionRetentionSchedule(365 * 24 * time.Hour)
+	cases := []struct {
+		age      time.Duration
+		wantStep time.Duration
+		wantOK   bool
+	}{
+		{30 * time.Minute, 0, true},
+		{12 * time.Hour, time.Hour, true},
+		{10 * 24 * time.Hour, 24 * time.Hour, true},
+		{60 * 24 * time.Hour, 7 * 24 * time.Hour, true},
+		{400 * 24 * time.Hour, 0, false},
+	}
+	for _, c := range cases {
+		step, ok := retentionStep(c.age, schedule)
+		if ok != c.wantOK || (ok && step != c.wantStep) {
+			t.Errorf("retentionStep(%v, _) = (%v, %v), want (%v, %v)", c.age, step, ok, c.wantStep, c.wantOK)
+		}
+	}
+}
+
+// box builds one ISO-BMFF box (32-bit size + fourCC + payload) for test fixtures.
+func box(fourCC string, payload []byte) []byte {
+	var buf bytes.Buffer
+	size := uint32(8 + len(payload))
+	binary.Write(&buf, binary.BigEndian, size)
+	buf.WriteString(fourCC)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func TestMvhdTime(t *testing.T) {
+	// version-0 mvhd: 1 byte version, 3 bytes flags, 4 bytes creation_time.
+	wantSeconds := uint32(3000000000)
+	mvhdPayload := make([]byte, 8)
+	binary.BigEndian.PutUint32(mvhdPayload[4:8], wantSeconds)
+	mvhd := box("mvhd", mvhdPayload)
+
+	// an unrelated sibling box before mvhd exercises findChildBox's skip path.
+	moovPayload := append(box("free", []byte("padding")), mvhd...)
+	moov := box("moov", moovPayload)
+
+	// an unrelated top-level box before moov exercises findTopLevelBox's skip path.
+	stream := append(box("ftyp", []byte("isom")), moov...)
+
+	got, err := mvhdTime(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("mvhdTime: %v", err)
+	}
+	want := quicktimeEpoch.Add(time.Duration(wantSeconds) * time.Second)
+	if !got.Equal(want) {
+		t.Errorf("mvhdTime = %v, want %v", got, want)
+	}
+}
+
+func TestMvhdTimeMissingMoov(t *testing.T) {
+	stream := box("ftyp", []byte("isom"))
+	if _, err := mvhdTime(bytes.NewReader(stream)); err == nil {
+		t.Error("mvhdTime: expected error for a stream with no moov box, got nil")
+	}
+}
+
+// TestManifestUndoRoundTrip processes a small src tree (a plain move and a
+// dedup-remove) with -manifest on, then -undo's that manifest, and asserts
+// every file lands back exactly where it started.
+func TestManifestUndoRoundTrip(t *testing.T) {
+	tmp := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll("src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("src/unique.jpg", []byte("unique contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("src/dup.jpg", []byte("dup contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2023, 5, 6, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes("src/unique.jpg", when, when); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("src/dup.jpg", when, when); err != nil {
+		t.Fatal(err)
+	}
+	// dst already has a same-named, same-content file, so dup.jpg will
+	// take the dedup-remove path instead of a plain move.
+	if err := os.MkdirAll("dst/2023/05", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("dst/2023/05/dup.jpg", []byte("dup contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifestFile, err := os.OpenFile("manifest.jsonl", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := options{out: defaultOutTemplate, workers: 1, manifest: manifestFile}
+	processDir("src", "dst", opts)
+	manifestFile.Close()
+
+	if _, err := os.Stat("dst/2023/05/unique.jpg"); err != nil {
+		t.Fatalf("unique.jpg was not moved into dst: %v", err)
+	}
+	if _, err := os.Stat("src/dup.jpg"); err == nil {
+		t.Fatal("dup.jpg should have been removed as a dedup, but is still in src")
+	}
+
+	if err := runUndo("manifest.jsonl", false); err != nil {
+		t.Fatalf("runUndo: %v", err)
+	}
+
+	data, err := os.ReadFile("src/unique.jpg")
+	if err != nil {
+		t.Fatalf("undo did not restore src/unique.jpg: %v", err)
+	}
+	if string(data) != "unique contents" {
+		t.Errorf("src/unique.jpg contents = %q, want %q", data, "unique contents")
+	}
+	data, err = os.ReadFile("src/dup.jpg")
+	if err != nil {
+		t.Fatalf("undo did not restore src/dup.jpg: %v", err)
+	}
+	if string(data) != "dup contents" {
+		t.Errorf("src/dup.jpg contents = %q, want %q", data, "dup contents")
+	}
+	if _, err := os.Stat("dst/2023/05/unique.jpg"); err == nil {
+		t.Error("undo should have moved unique.jpg back out of dst")
+	}
+}